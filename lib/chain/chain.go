@@ -16,12 +16,14 @@
 package chain
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/appnexus/schema-tool/lib/log"
@@ -50,9 +52,30 @@ type Alter struct {
 	FileName  string
 	Direction Direction
 
+	// ContentHash is the SHA-256 digest (hex-encoded) of the alter's body,
+	// i.e. everything after the header block, with line endings normalized
+	// to "\n". It is used to detect drift between what was applied to a
+	// schema and what is currently on disk.
+	ContentHash string
+
+	// Meta is the structured, typed form of the alter's header. It is
+	// always populated, regardless of whether the header was written as
+	// a TOML front-matter block or the legacy flat "-- key: value" form,
+	// so downstream validation has one shape to reason about.
+	Meta Meta
+
+	// SourceRoot is the root directory (as passed to ScanTree) that this
+	// alter was discovered under. Empty for alters discovered via the
+	// single-directory ScanDirectory.
+	SourceRoot string
+
 	// Internal temporary values used to build the chain
-	ref     string
-	backRef string
+	ref string
+
+	// backRefs holds every parent ref this alter declares. Most alters
+	// have at most one; an alter with more than one is a merge alter,
+	// joining multiple branches.
+	backRefs []string
 
 	// skipped and required environments. Not exported at the alter-level
 	// because validations must be completed at the AlterGroup level and
@@ -61,6 +84,17 @@ type Alter struct {
 	skipEnv    []string
 }
 
+// Ref returns the alter's unique identifier, as parsed from its header.
+func (a *Alter) Ref() string {
+	return a.ref
+}
+
+// BackRefs returns the refs of every parent this alter declares. An
+// alter declaring more than one is a merge alter.
+func (a *Alter) BackRefs() []string {
+	return a.backRefs
+}
+
 func newDefaultAlter() *Alter {
 	return &Alter{
 		Direction:  Undefined,
@@ -69,24 +103,105 @@ func newDefaultAlter() *Alter {
 	}
 }
 
-// AlterGroup represents and up/down pair of Alter objects along with links to
-// "forward" (child) and "back" (parent) AlterGroup objects.
+// AlterGroup represents an up/down pair of Alter objects along with links
+// to "forward" (child) and "back" (parent) AlterGroup objects.
 //
-// AlterGroup objects are a node in a doubly-linked list
+// AlterGroup objects are a node in a DAG: ForwardRef holds every child at
+// a branch point, and BackRef holds every parent of a merge alter.
 type AlterGroup struct {
 	Up         *Alter
 	Down       *Alter
-	ForwardRef *AlterGroup
-	BackRef    *AlterGroup
+	ForwardRef []*AlterGroup
+	BackRef    []*AlterGroup
 	RequireEnv []string
 	SkipEnv    []string
 }
 
-// Chain is a container to point to the head and tail of a linked list of
-// AlterGroup objects.
+// Chain is a directed acyclic graph of AlterGroup nodes, supporting
+// branch points (a parent with several children) and merge alters (a
+// child with several parents). It replaces what used to be a strictly
+// linear linked list.
 type Chain struct {
-	Head *AlterGroup
-	Tail *AlterGroup
+	groups []*AlterGroup
+}
+
+// Roots returns every AlterGroup with no parent, sorted lexicographically
+// by ref for determinism. A valid chain has exactly one.
+func (c *Chain) Roots() []*AlterGroup {
+	var roots []*AlterGroup
+	for _, g := range c.groups {
+		if len(g.BackRef) == 0 {
+			roots = append(roots, g)
+		}
+	}
+	sortGroupsByRef(roots)
+	return roots
+}
+
+// Leaves returns every AlterGroup with no children, sorted
+// lexicographically by ref for determinism.
+func (c *Chain) Leaves() []*AlterGroup {
+	var leaves []*AlterGroup
+	for _, g := range c.groups {
+		if len(g.ForwardRef) == 0 {
+			leaves = append(leaves, g)
+		}
+	}
+	sortGroupsByRef(leaves)
+	return leaves
+}
+
+// TopoSort returns every AlterGroup in topological order (parents always
+// appear before their children) using Kahn's algorithm. Nodes that become
+// ready simultaneously are tie-broken by ref, lexicographically, so the
+// result is deterministic across runs. Returns an ErrCyclicChain Error if
+// the chain contains a cycle.
+func (c *Chain) TopoSort() ([]*AlterGroup, *Error) {
+	remaining := make(map[*AlterGroup]int, len(c.groups))
+	var ready []*AlterGroup
+	for _, g := range c.groups {
+		remaining[g] = len(g.BackRef)
+		if len(g.BackRef) == 0 {
+			ready = append(ready, g)
+		}
+	}
+
+	sorted := make([]*AlterGroup, 0, len(c.groups))
+	for len(ready) > 0 {
+		sortGroupsByRef(ready)
+		next := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, next)
+
+		for _, child := range next.ForwardRef {
+			remaining[child]--
+			if remaining[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+
+	if len(sorted) != len(c.groups) {
+		return nil, &Error{
+			ErrType: ErrCyclicChain,
+			Message: "Chain is cyclic and cannot be topologically sorted",
+		}
+	}
+	return sorted, nil
+}
+
+func sortGroupsByRef(groups []*AlterGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Up.ref < groups[j].Up.ref
+	})
+}
+
+func refsOf(groups []*AlterGroup) []string {
+	refs := make([]string, len(groups))
+	for i, g := range groups {
+		refs[i] = g.Up.ref
+	}
+	return refs
 }
 
 const (
@@ -141,150 +256,95 @@ func BuildAndValidateChain(groups map[string]*AlterGroup) (*Chain, *Error) {
 			}
 		}
 
-		// validate matching back-ref's
-		if group.Up.backRef != group.Down.backRef {
-			return nil, &Error{
-				ErrType: ErrInvalidMetaData,
-				Message: fmt.Sprintf("'back-ref' values for %s do not match (%s and %s)",
-					group.Up.ref, group.Up.backRef, group.Down.backRef),
-			}
-		}
-
-		// Validate skip-env(s) for group
-		if len(group.Up.skipEnv) != len(group.Down.skipEnv) {
-			return nil, &Error{
-				ErrType: ErrInvalidMetaData,
-				Message: fmt.Sprintf(
-					"Different number of skip-env's found in:\n"+
-						"\t%s\n\t%s\n"+
-						"These files must contain the same skip-env values.",
-					group.Up.FileName, group.Down.FileName),
-			}
-		}
-		for _, skipUp := range group.Up.skipEnv {
-			found := false
-			for _, skipDown := range group.Down.skipEnv {
-				if skipUp == skipDown {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return nil, &Error{
-					ErrType: ErrInvalidMetaData,
-					Message: fmt.Sprintf(
-						"skip-env value '%s' is not found in both up & down alters", skipUp),
-				}
-			}
+		// Validate that the up/down pair's structured Meta agree on
+		// everything but Direction (back-ref, transactionality, timeout,
+		// tags, and per-environment behavior all must match).
+		if cErr := metaEquivalent(&group.Up.Meta, &group.Down.Meta, group.Up.FileName, group.Down.FileName); cErr != nil {
+			return nil, cErr
 		}
-		group.SkipEnv = group.Up.skipEnv
+		group.RequireEnv = envNamesWhere(group.Up.Meta.Env, func(s EnvSpec) bool { return s.Require })
+		group.SkipEnv = envNamesWhere(group.Up.Meta.Env, func(s EnvSpec) bool { return s.Skip })
+	}
 
-		// Validate require-env(s) for group
-		if len(group.Up.requireEnv) != len(group.Down.requireEnv) {
-			return nil, &Error{
-				ErrType: ErrInvalidMetaData,
-				Message: fmt.Sprintf("Uneven number of require-env's found in '%s' and '%s'",
-					group.Up.FileName, group.Down.FileName),
-			}
-		}
-		for _, requireUp := range group.Up.requireEnv {
-			found := false
-			for _, requireDown := range group.Down.requireEnv {
-				if requireUp == requireDown {
-					found = true
-					break
-				}
-			}
-			if !found {
+	// Build the DAG edges: every back-ref must resolve to a real group.
+	// An alter naming more than one back-ref is a merge alter and joins
+	// multiple branches; a group fed as a back-ref by more than one child
+	// is a branch point. Neither is an error on its own anymore - only
+	// an invalid back-ref, more than one root, or a cycle is.
+	for _, group := range groups {
+		for _, backRef := range group.Up.backRefs {
+			parent, ok := groups[backRef]
+			if !ok {
 				return nil, &Error{
 					ErrType: ErrInvalidMetaData,
-					Message: fmt.Sprintf(
-						"require-env value '%s' is not found in both up & down alters",
-						requireUp),
+					Message: fmt.Sprintf("Invalid backref '%s' found for '%s'",
+						backRef, group.Up.FileName),
 				}
 			}
+			group.BackRef = append(group.BackRef, parent)
+			parent.ForwardRef = append(parent.ForwardRef, group)
 		}
-		group.RequireEnv = group.Up.requireEnv
 	}
 
-	// Start to build the chain, but while building watch for:
-	//   - divergent (split) chains
-	//   - backRef's are valid (point to something)
-
-	var head *AlterGroup
-	var tail *AlterGroup
-
+	allGroups := make([]*AlterGroup, 0, len(groups))
 	for _, group := range groups {
-		backRef := group.Up.backRef
-		if backRef == "" {
-			// could be a head-alter, skip
-			continue
+		allGroups = append(allGroups, group)
+	}
+	chain := &Chain{groups: allGroups}
+
+	roots := chain.Roots()
+	if len(roots) == 0 {
+		return nil, &Error{
+			ErrType: ErrCyclicChain,
+			Message: "Chain has no root alter; every alter has a back-ref, which means the chain is cyclic",
 		}
-		parent, ok := groups[backRef]
-		if !ok {
-			return nil, &Error{
-				ErrType: ErrInvalidMetaData,
-				Message: fmt.Sprintf("Invalid backref '%s' found for '%s'",
-					backRef, group.Up.FileName),
-			}
+	}
+	if len(roots) > 1 {
+		return nil, &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf(
+				"Multiple root alters found (%s). Chain must have exactly one root alter.",
+				strings.Join(refsOf(roots), ", ")),
 		}
+	}
 
-		// is always nil before set, impossible for previous loop to write this value
-		group.BackRef = parent
-
-		// If a forward-ref is not nil, then it has previously been established as a
-		// parent alter. We have found a divergence in the chain.
-		if parent.ForwardRef != nil {
-			return nil, &Error{
-				ErrType: ErrInvalidMetaData,
-				Message: fmt.Sprintf(
-					"Duplicate parent defined in %s and %s - both point to %s. Chain must be linear.",
-					parent.ForwardRef.Up.ref,
-					group.Up.ref,
-					parent.Up.ref),
-			}
-		}
-		parent.ForwardRef = group
+	sorted, cErr := chain.TopoSort()
+	if cErr != nil {
+		return nil, cErr
 	}
 
-	// Get head & tail from built chain and also make sure that no duplicate roots
-	// are found. As for other potential errors:
-	//   - abandoned alters
-	//   - multiple tails (no next-refs)
-	// These are already validated. Abandoned alters would have invalid refs,
-	// duplicate parents, or be identified as a duplicate root. Tails would be
-	// directed earlier as a divergent chain.
-	for _, group := range groups {
-		if group.BackRef == nil {
-			if head != nil {
-				return nil, &Error{
-					ErrType: ErrInvalidMetaData,
-					Message: fmt.Sprintf(
-						"Duplicate root alters found (%s and %s). Chain must have one root alter.",
-						group.Up.ref,
-						head.Up.ref),
-				}
-			}
-			head = group
-		}
-		// Cannot have duplicate tail without already encountering another error
-		if group.ForwardRef == nil {
-			tail = group
-		}
+	if cErr := validateReachableFromRoot(roots[0], sorted); cErr != nil {
+		return nil, cErr
 	}
 
-	if head == nil || tail == nil {
-		return nil, &Error{
-			ErrType: ErrCyclicChain,
-			Message: "Chain is cyclic and has no head or tail",
+	return chain, nil
+}
+
+// validateReachableFromRoot walks forward from root over ForwardRef edges
+// and confirms every group produced by a successful TopoSort is reached,
+// i.e. the chain has no alters orphaned from the root.
+func validateReachableFromRoot(root *AlterGroup, all []*AlterGroup) *Error {
+	visited := make(map[*AlterGroup]bool, len(all))
+	queue := []*AlterGroup{root}
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		if visited[group] {
+			continue
 		}
+		visited[group] = true
+		queue = append(queue, group.ForwardRef...)
 	}
 
-	chain := &Chain{
-		Head: head,
-		Tail: tail,
+	if len(visited) != len(all) {
+		return &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf(
+				"Chain has alters unreachable from root '%s'; the chain must be fully connected",
+				root.Up.ref),
+		}
 	}
-	return chain, nil
+	return nil
 }
 
 // ScanDirectory scans a given directory and return a mapping of AlterRef to
@@ -310,12 +370,12 @@ func ScanDirectory(dir string) (map[string]*AlterGroup, *Error) {
 		if isAlterFile(f.Name()) {
 			filePath := path.Join(dir, f.Name())
 
-			header, cErr := readHeader(dir + "/" + f.Name())
+			header, body, cErr := readHeader(dir + "/" + f.Name())
 			if cErr != nil {
 				return nil, cErr
 			}
 
-			alter, cErr := parseMeta(header, filePath)
+			alter, cErr := parseMeta(header, body, filePath)
 			if cErr != nil {
 				return nil, cErr
 			}
@@ -361,15 +421,16 @@ func isAlterFile(name string) bool {
 	return filenameRegex.MatchString(name)
 }
 
-// Read the first N lines of an alter file that represent the "header." This is
-// the bit of stuff that contains all the meta-data required in alters.
-func readHeader(filePath string) ([]string, *Error) {
-	var headerRegex = regexp.MustCompile(`^--`)
-	lines := make([]string, 256)
-
+// Read the header block of an alter file - the continuous run of lines
+// starting with "--" that holds all its meta-data - via a HeaderIter, and
+// return it as a slice of raw lines for the legacy/TOML parsers to
+// consume. The remainder of the file (the "body") is also returned,
+// joined back together with "\n", so that callers can derive a content
+// hash from it.
+func readHeader(filePath string) ([]string, string, *Error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return lines, &Error{
+		return nil, "", &Error{
 			ErrType:    ErrUnreadableAlter,
 			Message:    fmt.Sprintf("Unable to read file '%s'", filePath),
 			Underlying: err,
@@ -378,48 +439,55 @@ func readHeader(filePath string) ([]string, *Error) {
 	// clone file after we return
 	defer file.Close()
 
-	// read line by line
-	scanner := bufio.NewScanner(file)
-	i := 0
-	for scanner.Scan() {
-		if i == 256 {
-			return lines, &Error{
-				ErrType: ErrInvalidMetaData,
-				Message: `Header lines (continuous block of lines starting with '--')
-exceeds 256. Please add a blank line in-between the meta-data and any
-comment lines that may follow.`,
-			}
-		}
-		line := scanner.Text()
-		if headerRegex.MatchString(line) {
-			lines[i] = line
-			i++
-		} else {
-			// hit non-header line, we're done
-			return lines, nil
+	iter := NewHeaderIter(file, 0)
+	var lines []string
+	for {
+		_, _, raw, _, ok := iter.Next()
+		if !ok {
+			break
 		}
+		lines = append(lines, raw)
+	}
+	if cErr := iter.Err(); cErr != nil {
+		return nil, "", cErr
 	}
 
-	if err = scanner.Err(); err != nil {
-		return lines, &Error{
-			ErrType:    ErrUnreadableAlter,
-			Message:    fmt.Sprintf("Unable to read file '%s'", filePath),
-			Underlying: err,
-		}
+	body, cErr := iter.Remainder()
+	if cErr != nil {
+		return nil, "", cErr
 	}
 
-	return lines, nil
+	return lines, body, nil
+}
+
+// computeContentHash returns a hex-encoded SHA-256 digest of an alter's body,
+// normalizing CRLF line endings to LF first so the hash is stable across
+// checkouts on different platforms.
+func computeContentHash(body string) string {
+	normalized := strings.Replace(body, "\r\n", "\n", -1)
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
 }
 
 // Parse the meta-information from the file and return an Alter object.
+// Dispatches to the TOML front-matter parser when the header opens with
+// a "-- +++" fence, falling back to the legacy flat "-- key: value" form
+// otherwise so existing repos keep working unchanged.
+func parseMeta(lines []string, body string, filePath string) (*Alter, *Error) {
+	if hasTOMLFrontMatter(lines) {
+		return parseTOMLAlter(lines, body, filePath)
+	}
+	return parseLegacyMeta(lines, body, filePath)
+}
+
+// parseLegacyMeta parses the original flat, line-oriented header format.
 // Returns error if meta cannot be obtained or required information is
 // missing.
-func parseMeta(lines []string, filePath string) (*Alter, *Error) {
+func parseLegacyMeta(lines []string, body string, filePath string) (*Alter, *Error) {
 	// expect meta-lines to be single-line and in the form of
 	//   "-- key: value"
-	// regex checks for extraneous whitespace
-	var metaEntryRegex = regexp.MustCompile(`^--\s*([^\s]+)\s*:(.+)\s*$`)
-
+	// (metaEntryRegex, which checks for extraneous whitespace, lives in
+	// headeriter.go alongside the streaming parser that now shares it)
 	var alter = newDefaultAlter()
 	alter.FileName = filePath
 
@@ -439,13 +507,19 @@ func parseMeta(lines []string, filePath string) (*Alter, *Error) {
 				}
 				alter.ref = value
 			case "backref":
-				if value == "" {
+				backRefs := strings.Split(value, ",")
+				for _, backRef := range backRefs {
+					trimmedStr := strings.TrimSpace(backRef)
+					if trimmedStr != "" {
+						alter.backRefs = append(alter.backRefs, trimmedStr)
+					}
+				}
+				if len(alter.backRefs) == 0 {
 					return nil, &Error{
 						ErrType: ErrInvalidMetaData,
 						Message: fmt.Sprintf("Invalid 'backref' value found in '%s'", filePath),
 					}
 				}
-				alter.backRef = value
 			case "direction":
 				valueLower := strings.ToLower(value)
 				if valueLower == "up" {
@@ -481,6 +555,8 @@ func parseMeta(lines []string, filePath string) (*Alter, *Error) {
 		}
 	}
 
+	alter.ContentHash = computeContentHash(body)
+
 	if alter.ref == "" {
 		return nil, &Error{
 			ErrType: ErrInvalidMetaData,
@@ -494,11 +570,16 @@ func parseMeta(lines []string, filePath string) (*Alter, *Error) {
 			Message: "Missing required field 'direction'",
 		}
 	}
-	if len(alter.requireEnv) > 0 && len(alter.skipEnv) > 0 {
-		return nil, &Error{
-			ErrType: ErrInvalidMetaData,
-			Message: "Mutually exclusive fields 'require-env' and 'skip-env' cannot be used together",
-		}
+
+	envs, cErr := buildLegacyEnvSpec(alter.requireEnv, alter.skipEnv, filePath)
+	if cErr != nil {
+		return nil, cErr
+	}
+	alter.Meta = Meta{
+		Ref:       alter.ref,
+		BackRefs:  alter.backRefs,
+		Direction: alter.Direction,
+		Env:       envs,
 	}
 
 	return alter, nil
@@ -0,0 +1,178 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeAlterFileWithBackref writes an alter file named n-ref-direction.sql
+// whose header declares ref and, if non-empty, a comma-joined backref.
+func writeAlterFileWithBackref(t testing.TB, dir string, n int, ref, direction string, backref string) {
+	t.Helper()
+	name := fmt.Sprintf("%04d-%s-%s.sql", n, ref, direction)
+	content := fmt.Sprintf("-- ref: %s\n-- direction: %s\n", ref, direction)
+	if backref != "" {
+		content += fmt.Sprintf("-- backref: %s\n", backref)
+	}
+	content += "\nselect 1;\n"
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write alter file: %s", err)
+	}
+}
+
+func buildChainFromDir(t testing.TB, dir string) (*Chain, *Error) {
+	t.Helper()
+	groups, cErr := ScanDirectory(dir)
+	if cErr != nil {
+		t.Fatalf("ScanDirectory failed: %s", cErr.Message)
+	}
+	return BuildAndValidateChain(groups)
+}
+
+// TestBuildAndValidateChainDetectsCycle builds a chain with one reachable
+// root plus two alters that back-ref each other, forming a cycle TopoSort
+// cannot drain via Kahn's algorithm.
+func TestBuildAndValidateChainDetectsCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-chain-cycle")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAlterFileWithBackref(t, dir, 0, "root", "up", "")
+	writeAlterFileWithBackref(t, dir, 0, "root", "down", "")
+	writeAlterFileWithBackref(t, dir, 1, "a", "up", "b")
+	writeAlterFileWithBackref(t, dir, 1, "a", "down", "b")
+	writeAlterFileWithBackref(t, dir, 2, "b", "up", "a")
+	writeAlterFileWithBackref(t, dir, 2, "b", "down", "a")
+
+	_, cErr := buildChainFromDir(t, dir)
+	if cErr == nil {
+		t.Fatal("expected a cyclic chain to be rejected")
+	}
+	if cErr.ErrType != ErrCyclicChain {
+		t.Fatalf("expected ErrCyclicChain, got %d: %s", cErr.ErrType, cErr.Message)
+	}
+}
+
+// TestBuildAndValidateChainRejectsMultipleRoots builds two disconnected
+// root alters and confirms BuildAndValidateChain refuses to pick one.
+func TestBuildAndValidateChainRejectsMultipleRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-chain-multiroot")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAlterFileWithBackref(t, dir, 0, "root1", "up", "")
+	writeAlterFileWithBackref(t, dir, 0, "root1", "down", "")
+	writeAlterFileWithBackref(t, dir, 1, "root2", "up", "")
+	writeAlterFileWithBackref(t, dir, 1, "root2", "down", "")
+
+	_, cErr := buildChainFromDir(t, dir)
+	if cErr == nil {
+		t.Fatal("expected multiple disconnected roots to be rejected")
+	}
+	if cErr.ErrType != ErrInvalidMetaData {
+		t.Fatalf("expected ErrInvalidMetaData, got %d: %s", cErr.ErrType, cErr.Message)
+	}
+}
+
+// TestBuildAndValidateChainSortsBranchAndMerge builds a branch point
+// (root with two children) and a merge alter (two back-refs) and checks
+// that TopoSort produces a valid, deterministic order: parents before
+// children, ties broken lexicographically by ref.
+func TestBuildAndValidateChainSortsBranchAndMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-chain-branchmerge")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAlterFileWithBackref(t, dir, 0, "root", "up", "")
+	writeAlterFileWithBackref(t, dir, 0, "root", "down", "")
+	writeAlterFileWithBackref(t, dir, 1, "branchb", "up", "root")
+	writeAlterFileWithBackref(t, dir, 1, "branchb", "down", "root")
+	writeAlterFileWithBackref(t, dir, 2, "brancha", "up", "root")
+	writeAlterFileWithBackref(t, dir, 2, "brancha", "down", "root")
+	writeAlterFileWithBackref(t, dir, 3, "merge", "up", "brancha,branchb")
+	writeAlterFileWithBackref(t, dir, 3, "merge", "down", "brancha,branchb")
+
+	c, cErr := buildChainFromDir(t, dir)
+	if cErr != nil {
+		t.Fatalf("BuildAndValidateChain failed: %s", cErr.Message)
+	}
+
+	roots := c.Roots()
+	if len(roots) != 1 || roots[0].Up.Ref() != "root" {
+		t.Fatalf("expected a single root 'root', got %v", refsOf(roots))
+	}
+	leaves := c.Leaves()
+	if len(leaves) != 1 || leaves[0].Up.Ref() != "merge" {
+		t.Fatalf("expected a single leaf 'merge', got %v", refsOf(leaves))
+	}
+
+	sorted, cErr := c.TopoSort()
+	if cErr != nil {
+		t.Fatalf("TopoSort failed: %s", cErr.Message)
+	}
+	// root first, merge last, "brancha" before "branchb" since ties at
+	// the branch point are broken lexicographically by ref.
+	got := refsOf(sorted)
+	want := []string{"root", "brancha", "branchb", "merge"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected topological order %v, got %v", want, got)
+		}
+	}
+}
+
+// TestBuildAndValidateChainRejectsMismatchedMergeBackRefs ensures a merge
+// alter whose down back-refs disagree with its up's fails metaEquivalent
+// rather than silently building a DAG with inconsistent edges.
+func TestBuildAndValidateChainRejectsMismatchedMergeBackRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-chain-mergemismatch")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeAlterFileWithBackref(t, dir, 0, "root", "up", "")
+	writeAlterFileWithBackref(t, dir, 0, "root", "down", "")
+	writeAlterFileWithBackref(t, dir, 1, "branchb", "up", "root")
+	writeAlterFileWithBackref(t, dir, 1, "branchb", "down", "root")
+	writeAlterFileWithBackref(t, dir, 2, "brancha", "up", "root")
+	writeAlterFileWithBackref(t, dir, 2, "brancha", "down", "root")
+	writeAlterFileWithBackref(t, dir, 3, "merge", "up", "brancha,branchb")
+	// down only reverses one of the two parents merge's up declares.
+	writeAlterFileWithBackref(t, dir, 3, "merge", "down", "brancha")
+
+	_, cErr := buildChainFromDir(t, dir)
+	if cErr == nil {
+		t.Fatal("expected mismatched up/down back-refs on a merge alter to be rejected")
+	}
+	if cErr.ErrType != ErrInvalidMetaData {
+		t.Fatalf("expected ErrInvalidMetaData, got %d: %s", cErr.ErrType, cErr.Message)
+	}
+}
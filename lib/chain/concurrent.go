@@ -0,0 +1,174 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// ScanDirectoryConcurrent is ScanDirectory parallelized across workers
+// goroutines, for directories with enough alters that header parsing
+// (disk I/O plus TOML/regex decoding) is worth spreading out. Results are
+// identical to ScanDirectory's given the same directory; only the order
+// in which files are read is unspecified. A workers value of 0 or less
+// is treated as 1.
+func ScanDirectoryConcurrent(dir string, workers int) (map[string]*AlterGroup, *Error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	stat, err := os.Stat(dir)
+	if err != nil || !stat.IsDir() {
+		return nil, &Error{
+			Underlying: err,
+			Message:    fmt.Sprintf("Path '%s' is not a directory", dir),
+			ErrType:    ErrNonexistentDirectory,
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, &Error{
+			Underlying: err,
+			Message:    fmt.Sprintf("Unable to read directory '%s'", dir),
+			ErrType:    ErrUnreadableAlter,
+		}
+	}
+
+	names := make(chan string)
+	alterCh := make(chan *Alter)
+	errCh := make(chan *Error, 1)
+
+	var abortOnce sync.Once
+	abort := make(chan struct{})
+	reportErr := func(cErr *Error) {
+		abortOnce.Do(func() {
+			errCh <- cErr
+			close(abort)
+		})
+	}
+
+	var workerWg sync.WaitGroup
+	workerWg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer workerWg.Done()
+			for name := range names {
+				select {
+				case <-abort:
+					return
+				default:
+				}
+
+				filePath := path.Join(dir, name)
+				header, body, cErr := readHeader(filePath)
+				if cErr != nil {
+					reportErr(cErr)
+					return
+				}
+				alter, cErr := parseMeta(header, body, filePath)
+				if cErr != nil {
+					reportErr(cErr)
+					return
+				}
+
+				select {
+				case alterCh <- alter:
+				case <-abort:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(names)
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if !isAlterFile(f.Name()) {
+				continue
+			}
+			select {
+			case names <- f.Name():
+			case <-abort:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		workerWg.Wait()
+		close(alterCh)
+	}()
+
+	// alterCh has exactly one consumer (this loop), so alters is never
+	// accessed concurrently and needs no lock.
+	alters := make(map[string]*AlterGroup)
+	for alter := range alterCh {
+		if cErr := mergeAlter(alters, alter); cErr != nil {
+			reportErr(cErr)
+		}
+	}
+
+	select {
+	case cErr := <-errCh:
+		return nil, cErr
+	default:
+	}
+
+	if len(alters) == 0 {
+		return nil, &Error{
+			ErrType: ErrEmptyDirectory,
+			Message: fmt.Sprintf("Directory '%s' does not contain any alters", dir),
+		}
+	}
+
+	return alters, nil
+}
+
+// mergeAlter adds alter to alters, keyed by ref, returning an
+// ErrDuplicateRef if its direction is already populated for that ref.
+func mergeAlter(alters map[string]*AlterGroup, alter *Alter) *Error {
+	group, ok := alters[alter.ref]
+	if !ok {
+		group = &AlterGroup{}
+	}
+	if alter.Direction == Up {
+		if group.Up != nil {
+			return &Error{
+				ErrType: ErrDuplicateRef,
+				Message: fmt.Sprintf("Duplicate 'up' alter for ref '%s'", alter.ref),
+			}
+		}
+		group.Up = alter
+	} else if alter.Direction == Down {
+		if group.Down != nil {
+			return &Error{
+				ErrType: ErrDuplicateRef,
+				Message: fmt.Sprintf("Duplicate 'down' alter for ref '%s'", alter.ref),
+			}
+		}
+		group.Down = alter
+	}
+	alters[alter.ref] = group
+	return nil
+}
@@ -0,0 +1,132 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeAlterFile writes a minimal, valid alter file named to satisfy
+// isAlterFile's filename convention.
+func writeAlterFile(t testing.TB, dir string, n int, direction string) {
+	t.Helper()
+	name := fmt.Sprintf("%04d-case-%s.sql", n, direction)
+	content := fmt.Sprintf("-- ref: ref%04d\n-- direction: %s\n\nselect 1;\n", n, direction)
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write alter file: %s", err)
+	}
+}
+
+// TestReadHeaderNoLineCap is a regression test for the old hardcoded
+// 256-line header cap: a header well past that length, followed by a
+// blank separator line, now parses successfully instead of erroring.
+func TestReadHeaderNoLineCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-headercap")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var b strings.Builder
+	for i := 0; i < 400; i++ {
+		fmt.Fprintf(&b, "-- tag-%d: noise\n", i)
+	}
+	b.WriteString("-- ref: bigheader\n-- direction: up\n\nselect 1;\n")
+
+	filePath := path.Join(dir, "0001-big-up.sql")
+	if err := ioutil.WriteFile(filePath, []byte(b.String()), 0644); err != nil {
+		t.Fatalf("unable to write alter file: %s", err)
+	}
+
+	header, body, cErr := readHeader(filePath)
+	if cErr != nil {
+		t.Fatalf("readHeader failed on a >256 line header: %s", cErr.Message)
+	}
+	if len(header) != 402 {
+		t.Fatalf("expected 402 header lines, got %d", len(header))
+	}
+	if body != "\nselect 1;" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+// TestScanDirectoryConcurrentMatchesScanDirectory checks that the
+// concurrent scanner produces the same alters as the sequential one.
+func TestScanDirectoryConcurrentMatchesScanDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-concurrent")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 50; i++ {
+		writeAlterFile(t, dir, i, "up")
+		writeAlterFile(t, dir, i, "down")
+	}
+
+	want, cErr := ScanDirectory(dir)
+	if cErr != nil {
+		t.Fatalf("ScanDirectory failed: %s", cErr.Message)
+	}
+	got, cErr := ScanDirectoryConcurrent(dir, 8)
+	if cErr != nil {
+		t.Fatalf("ScanDirectoryConcurrent failed: %s", cErr.Message)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected %d refs, got %d", len(want), len(got))
+	}
+	for ref, group := range want {
+		gotGroup, ok := got[ref]
+		if !ok {
+			t.Fatalf("missing ref %q in concurrent scan", ref)
+		}
+		if gotGroup.Up.ContentHash != group.Up.ContentHash || gotGroup.Down.ContentHash != group.Down.ContentHash {
+			t.Fatalf("content hash mismatch for ref %q", ref)
+		}
+	}
+}
+
+// BenchmarkScan10k scans a directory of 10,000 alter files (5,000
+// up/down pairs) to demonstrate that per-file allocations stay bounded
+// by file size rather than growing with the number of files scanned so
+// far - the old fixed make([]string, 256) allocation is gone, and
+// HeaderIter streams each header directly off its own bufio.Scanner.
+func BenchmarkScan10k(b *testing.B) {
+	dir, err := ioutil.TempDir("", "schema-tool-bench10k")
+	if err != nil {
+		b.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 5000; i++ {
+		writeAlterFile(b, dir, i, "up")
+		writeAlterFile(b, dir, i, "down")
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, cErr := ScanDirectoryConcurrent(dir, 8); cErr != nil {
+			b.Fatalf("ScanDirectoryConcurrent failed: %s", cErr.Message)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// defaultHeaderByteBudget bounds how many bytes of header content
+// readHeader/HeaderIter will accept before giving up, replacing the old
+// hardcoded 256-line cap. It's large enough that a long license header
+// doesn't require a blank separator line, while still catching a file
+// that never closes its header block.
+const defaultHeaderByteBudget = 64 * 1024
+
+var headerLineRegex = regexp.MustCompile(`^--`)
+var metaEntryRegex = regexp.MustCompile(`^--\s*([^\s]+)\s*:(.+)\s*$`)
+
+// HeaderIter streams the "-- ..." header block of an alter file one line
+// at a time directly off a bufio.Scanner, rather than materializing every
+// line up front. It stops at the first non-header line (or EOF), which
+// callers can then recover via Remainder.
+type HeaderIter struct {
+	scanner  *bufio.Scanner
+	budget   int
+	consumed int
+	lineNo   int
+
+	pending     string
+	havePending bool
+	err         *Error
+}
+
+// NewHeaderIter returns a HeaderIter reading from r. A budget of 0 uses
+// defaultHeaderByteBudget.
+func NewHeaderIter(r io.Reader, budget int) *HeaderIter {
+	if budget == 0 {
+		budget = defaultHeaderByteBudget
+	}
+	return &HeaderIter{scanner: bufio.NewScanner(r), budget: budget}
+}
+
+// Next advances to the next header line and reports whether one was
+// found. It returns false once a non-header line, EOF, a scan error, or
+// the byte budget is reached - check Err() to tell a clean stop from a
+// failure.
+func (h *HeaderIter) Next() (key, value, raw string, lineNo int, ok bool) {
+	if h.err != nil {
+		return "", "", "", 0, false
+	}
+	if !h.scanner.Scan() {
+		if err := h.scanner.Err(); err != nil {
+			h.err = &Error{ErrType: ErrUnreadableAlter, Message: "Unable to read alter", Underlying: err}
+		}
+		return "", "", "", 0, false
+	}
+
+	h.lineNo++
+	line := h.scanner.Text()
+	if !headerLineRegex.MatchString(line) {
+		h.pending = line
+		h.havePending = true
+		return "", "", "", 0, false
+	}
+
+	h.consumed += len(line) + 1
+	if h.consumed > h.budget {
+		h.err = &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf(
+				"Header block exceeds the %d byte budget. Please add a blank line "+
+					"in-between the meta-data and any comment lines that may follow.",
+				h.budget),
+		}
+		return "", "", "", 0, false
+	}
+
+	if matches := metaEntryRegex.FindStringSubmatch(line); len(matches) == 3 {
+		key = strings.ToLower(strings.TrimSpace(matches[1]))
+		value = strings.TrimSpace(matches[2])
+	}
+	return key, value, line, h.lineNo, true
+}
+
+// Err returns the error, if any, that caused Next to stop.
+func (h *HeaderIter) Err() *Error {
+	return h.err
+}
+
+// Remainder reads and returns everything after the header block
+// (including the first non-header line already consumed by Next),
+// joined with "\n".
+func (h *HeaderIter) Remainder() (string, *Error) {
+	var lines []string
+	if h.havePending {
+		lines = append(lines, h.pending)
+	}
+	for h.scanner.Scan() {
+		lines = append(lines, h.scanner.Text())
+	}
+	if err := h.scanner.Err(); err != nil {
+		return "", &Error{ErrType: ErrUnreadableAlter, Message: "Unable to read alter", Underlying: err}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,220 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+// Package integrity provides content-addressable drift detection for
+// applied alters. Every ref in a chain is recorded once in a manifest,
+// keyed by ref, with its 'up' and 'down' content hashes (see Alter.ContentHash),
+// mirroring the "hash every path, roll the hashes up" approach used by
+// tools like buildkit's contenthash: a single "chain digest" is the hash
+// of the concatenation of (ref, up_hash, down_hash) tuples in chain
+// order, so two branches (or a checkout and CI) can be compared with one
+// string.
+package integrity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/appnexus/schema-tool/lib/chain"
+)
+
+// ManifestEntry records the content hashes that were observed for a ref
+// the last time it was applied.
+type ManifestEntry struct {
+	Ref      string `json:"ref"`
+	UpHash   string `json:"up_hash"`
+	DownHash string `json:"down_hash"`
+}
+
+// Manifest is the on-disk record (conventionally "schema.lock" alongside
+// the schema directory) of every applied alter's content hashes, plus the
+// rolled-up digest of the chain as a whole at the time it was written.
+type Manifest struct {
+	ChainDigest string                    `json:"chain_digest"`
+	Refs        map[string]*ManifestEntry `json:"refs"`
+}
+
+// ManifestReader abstracts away where a Manifest comes from so VerifyChain
+// can be exercised without touching disk.
+type ManifestReader interface {
+	Read() (*Manifest, error)
+}
+
+// FileManifestReader reads a Manifest from a JSON file on disk, e.g. the
+// "schema.lock" that sits next to a schema directory.
+type FileManifestReader struct {
+	Path string
+}
+
+// Read implements ManifestReader by loading and decoding the manifest at
+// Path. A missing file is treated as an empty manifest so that the very
+// first run of a previously un-tracked chain doesn't error.
+func (r *FileManifestReader) Read() (*Manifest, error) {
+	bytes, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Manifest{Refs: make(map[string]*ManifestEntry)}, nil
+		}
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(bytes, manifest); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest '%s': %s", r.Path, err)
+	}
+	if manifest.Refs == nil {
+		manifest.Refs = make(map[string]*ManifestEntry)
+	}
+	return manifest, nil
+}
+
+// WriteManifest persists a Manifest to path as indented JSON so it's
+// reasonable to diff in a PR.
+func WriteManifest(path string, manifest *Manifest) error {
+	bytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0644)
+}
+
+// BuildManifest walks a chain in topological order and records the
+// current content hash of every alter's up and down body, along with the
+// rolled-up ChainDigest. It's the manifest a caller would write
+// immediately after successfully applying (or verifying) a chain in full.
+func BuildManifest(c *chain.Chain) (*Manifest, *chain.Error) {
+	sorted, cErr := c.TopoSort()
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	manifest := &Manifest{Refs: make(map[string]*ManifestEntry)}
+
+	var tuples []string
+	for _, group := range sorted {
+		entry := &ManifestEntry{
+			Ref:      refOf(group),
+			UpHash:   group.Up.ContentHash,
+			DownHash: group.Down.ContentHash,
+		}
+		manifest.Refs[refOf(group)] = entry
+		tuples = append(tuples, refOf(group)+":"+entry.UpHash+":"+entry.DownHash)
+	}
+
+	manifest.ChainDigest = hashTuples(tuples)
+	return manifest, nil
+}
+
+// Drift describes a single alter whose on-disk content no longer matches
+// what was recorded in the manifest the last time it was applied.
+type Drift struct {
+	Ref       string
+	Direction chain.Direction
+	Expected  string
+	Actual    string
+}
+
+func (d Drift) String() string {
+	dir := "up"
+	if d.Direction == chain.Down {
+		dir = "down"
+	}
+	return fmt.Sprintf("ref '%s' (%s) expected content hash %s but found %s",
+		d.Ref, dir, d.Expected, d.Actual)
+}
+
+// VerifyChain compares every alter currently present in chain against the
+// hashes recorded by manifest and reports a Drift for each mismatch. Refs
+// present in the chain but absent from the manifest are not considered
+// drift - they simply haven't been applied (and recorded) yet.
+func VerifyChain(c *chain.Chain, manifest ManifestReader) ([]Drift, error) {
+	m, err := manifest.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	sorted, cErr := c.TopoSort()
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	var drifts []Drift
+	for _, group := range sorted {
+		entry, ok := m.Refs[refOf(group)]
+		if !ok {
+			continue
+		}
+		if entry.UpHash != group.Up.ContentHash {
+			drifts = append(drifts, Drift{
+				Ref:       refOf(group),
+				Direction: chain.Up,
+				Expected:  entry.UpHash,
+				Actual:    group.Up.ContentHash,
+			})
+		}
+		if entry.DownHash != group.Down.ContentHash {
+			drifts = append(drifts, Drift{
+				Ref:       refOf(group),
+				Direction: chain.Down,
+				Expected:  entry.DownHash,
+				Actual:    group.Down.ContentHash,
+			})
+		}
+	}
+	return drifts, nil
+}
+
+// ValidateFrozen returns an error if the tail-of-chain digest computed
+// from c disagrees with the digest recorded in manifest. This is the hook
+// a "--frozen" mode would call before refusing to run against a chain
+// that has diverged from what CI last verified.
+func ValidateFrozen(c *chain.Chain, manifest ManifestReader) error {
+	m, err := manifest.Read()
+	if err != nil {
+		return err
+	}
+
+	built, cErr := BuildManifest(c)
+	if cErr != nil {
+		return cErr
+	}
+
+	if built.ChainDigest != m.ChainDigest {
+		return fmt.Errorf(
+			"chain digest %s disagrees with manifest digest %s - refusing to run in frozen mode",
+			built.ChainDigest, m.ChainDigest)
+	}
+	return nil
+}
+
+// refOf returns the ref an AlterGroup was parsed under.
+func refOf(group *chain.AlterGroup) string {
+	return group.Up.Ref()
+}
+
+// hashTuples computes the rolled-up "chain digest": the SHA-256 of every
+// "ref:up_hash:down_hash" tuple, newline-joined, in chain order.
+func hashTuples(tuples []string) string {
+	h := sha256.New()
+	for _, t := range tuples {
+		h.Write([]byte(t))
+		h.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
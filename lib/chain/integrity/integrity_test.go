@@ -0,0 +1,166 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package integrity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/appnexus/schema-tool/lib/chain"
+)
+
+// writeAlterFile writes a minimal, valid alter file named to satisfy
+// ScanDirectory's filename convention.
+func writeAlterFile(t testing.TB, dir string, n int, direction, body string) {
+	t.Helper()
+	name := fmt.Sprintf("%04d-case-%s.sql", n, direction)
+	content := fmt.Sprintf("-- ref: ref%04d\n-- direction: %s\n\n%s\n", n, direction, body)
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write alter file: %s", err)
+	}
+}
+
+// buildChain writes a single ref0000 up/down pair into dir and builds a
+// Chain out of it.
+func buildChain(t testing.TB, dir, upBody, downBody string) *chain.Chain {
+	t.Helper()
+	writeAlterFile(t, dir, 0, "up", upBody)
+	writeAlterFile(t, dir, 0, "down", downBody)
+
+	groups, cErr := chain.ScanDirectory(dir)
+	if cErr != nil {
+		t.Fatalf("ScanDirectory failed: %s", cErr.Message)
+	}
+	c, cErr := chain.BuildAndValidateChain(groups)
+	if cErr != nil {
+		t.Fatalf("BuildAndValidateChain failed: %s", cErr.Message)
+	}
+	return c
+}
+
+// memManifestReader is a ManifestReader backed by an in-memory Manifest,
+// used to exercise VerifyChain/ValidateFrozen without touching disk.
+type memManifestReader struct {
+	manifest *Manifest
+}
+
+func (r *memManifestReader) Read() (*Manifest, error) {
+	return r.manifest, nil
+}
+
+func TestVerifyChainNoDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-integrity")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := buildChain(t, dir, "select 1;", "select 2;")
+
+	manifest, cErr := BuildManifest(c)
+	if cErr != nil {
+		t.Fatalf("BuildManifest failed: %s", cErr.Message)
+	}
+
+	drifts, err := VerifyChain(c, &memManifestReader{manifest: manifest})
+	if err != nil {
+		t.Fatalf("VerifyChain failed: %s", err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("expected no drift, got %v", drifts)
+	}
+}
+
+func TestVerifyChainDetectsDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-integrity")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := buildChain(t, dir, "select 1;", "select 2;")
+
+	manifest, cErr := BuildManifest(c)
+	if cErr != nil {
+		t.Fatalf("BuildManifest failed: %s", cErr.Message)
+	}
+
+	// Mutate the up alter's body on disk after the manifest was recorded.
+	writeAlterFile(t, dir, 0, "up", "select 1, 2;")
+	groups, cErr := chain.ScanDirectory(dir)
+	if cErr != nil {
+		t.Fatalf("ScanDirectory failed: %s", cErr.Message)
+	}
+	c, cErr = chain.BuildAndValidateChain(groups)
+	if cErr != nil {
+		t.Fatalf("BuildAndValidateChain failed: %s", cErr.Message)
+	}
+
+	drifts, err := VerifyChain(c, &memManifestReader{manifest: manifest})
+	if err != nil {
+		t.Fatalf("VerifyChain failed: %s", err)
+	}
+	if len(drifts) != 1 {
+		t.Fatalf("expected exactly one drift, got %v", drifts)
+	}
+	if drifts[0].Ref != "ref0000" || drifts[0].Direction != chain.Up {
+		t.Fatalf("unexpected drift: %+v", drifts[0])
+	}
+}
+
+func TestValidateFrozenRejectsDivergedChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-integrity")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := buildChain(t, dir, "select 1;", "select 2;")
+
+	manifest, cErr := BuildManifest(c)
+	if cErr != nil {
+		t.Fatalf("BuildManifest failed: %s", cErr.Message)
+	}
+
+	if err := ValidateFrozen(c, &memManifestReader{manifest: manifest}); err != nil {
+		t.Fatalf("ValidateFrozen failed against its own manifest: %s", err)
+	}
+
+	manifest.ChainDigest = "stale-digest"
+	if err := ValidateFrozen(c, &memManifestReader{manifest: manifest}); err == nil {
+		t.Fatal("expected ValidateFrozen to reject a diverged chain digest")
+	}
+}
+
+func TestFileManifestReaderMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schema-tool-integrity")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	reader := &FileManifestReader{Path: path.Join(dir, "schema.lock")}
+	manifest, err := reader.Read()
+	if err != nil {
+		t.Fatalf("Read failed on a missing manifest: %s", err)
+	}
+	if len(manifest.Refs) != 0 {
+		t.Fatalf("expected an empty manifest, got %v", manifest.Refs)
+	}
+}
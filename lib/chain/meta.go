@@ -0,0 +1,284 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tomlFence delimits a TOML front-matter header block, e.g.:
+//
+//	-- +++
+//	-- ref = "abc123"
+//	-- [env.production]
+//	-- require = true
+//	-- +++
+const tomlFence = "+++"
+
+// EnvSpec captures per-environment behavior for an alter. It replaces the
+// legacy pair of flat, alter-wide "require-env"/"skip-env" lists with an
+// unambiguous, per-environment setting: a given environment can be
+// required by one alter and skipped by another without the two lists
+// having to agree on length or ever touching the same name.
+type EnvSpec struct {
+	// Skip means this alter is not applied when running against this
+	// environment.
+	Skip bool `toml:"skip"`
+
+	// Require means this alter only applies to this environment; it is
+	// skipped everywhere else.
+	Require bool `toml:"require"`
+}
+
+// Meta is the typed, structured form of an alter's header metadata.
+// Every Alter populates Meta, whether its header was written as a TOML
+// front-matter block or the legacy flat "-- key: value" form, so
+// BuildAndValidateChain has one shape to compare between an up/down pair.
+type Meta struct {
+	Ref string `toml:"ref"`
+	// BackRefs holds every parent ref this alter declares. An alter
+	// naming more than one is a merge alter, joining multiple branches.
+	BackRefs       []string           `toml:"back-refs"`
+	Direction      Direction          `toml:"direction"`
+	Transactional  bool               `toml:"transactional"`
+	TimeoutSeconds int                `toml:"timeout-seconds"`
+	Tags           []string           `toml:"tags"`
+	Env            map[string]EnvSpec `toml:"env"`
+}
+
+// UnmarshalText lets Direction be decoded directly from a TOML string
+// value ("up" / "down"), mirroring the case-insensitive handling the
+// legacy parser already applies to the "direction" key.
+func (d *Direction) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "up":
+		*d = Up
+	case "down":
+		*d = Down
+	default:
+		return fmt.Errorf("invalid direction %q", text)
+	}
+	return nil
+}
+
+// stripHeaderPrefix removes the leading comment marker ("-- ", or just
+// "--" if there's no trailing space) that every header line carries.
+func stripHeaderPrefix(line string) string {
+	if strings.HasPrefix(line, "-- ") {
+		return line[len("-- "):]
+	}
+	return strings.TrimPrefix(line, "--")
+}
+
+// hasTOMLFrontMatter reports whether header (the raw "-- ..." lines
+// returned by readHeader) opens with a "-- +++" fence.
+func hasTOMLFrontMatter(header []string) bool {
+	if len(header) == 0 {
+		return false
+	}
+	return strings.TrimSpace(stripHeaderPrefix(header[0])) == tomlFence
+}
+
+// parseTOMLAlter decodes a "-- +++" delimited TOML front-matter block
+// into an Alter. header is expected to have already been confirmed to
+// open with the fence via hasTOMLFrontMatter.
+func parseTOMLAlter(header []string, body string, filePath string) (*Alter, *Error) {
+	var tomlLines []string
+	opened := false
+	closed := false
+	for _, line := range header {
+		stripped := stripHeaderPrefix(line)
+		if strings.TrimSpace(stripped) == tomlFence {
+			if !opened {
+				opened = true
+				continue
+			}
+			closed = true
+			break
+		}
+		if opened {
+			tomlLines = append(tomlLines, stripped)
+		}
+	}
+	if !closed {
+		return nil, &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf(
+				"Unterminated TOML front-matter block (missing closing '+++') in '%s'", filePath),
+		}
+	}
+
+	meta := &Meta{}
+	if _, err := toml.Decode(strings.Join(tomlLines, "\n"), meta); err != nil {
+		return nil, &Error{
+			ErrType:    ErrInvalidMetaData,
+			Message:    fmt.Sprintf("Unable to parse TOML front-matter in '%s': %s", filePath, err),
+			Underlying: err,
+		}
+	}
+
+	if meta.Ref == "" {
+		return nil, &Error{ErrType: ErrInvalidMetaData, Message: "Missing required field 'ref'"}
+	}
+	if !isValidRef(meta.Ref) {
+		return nil, &Error{ErrType: ErrInvalidMetaData, Message: "Invalid 'ref' value found in " + filePath}
+	}
+	if meta.Direction == Undefined {
+		return nil, &Error{ErrType: ErrInvalidMetaData, Message: "Missing required field 'direction'"}
+	}
+	for name, spec := range meta.Env {
+		if spec.Skip && spec.Require {
+			return nil, &Error{
+				ErrType: ErrInvalidMetaData,
+				Message: fmt.Sprintf(
+					"environment '%s' cannot be both required and skipped in '%s'", name, filePath),
+			}
+		}
+	}
+
+	alter := newDefaultAlter()
+	alter.FileName = filePath
+	alter.ref = meta.Ref
+	alter.backRefs = meta.BackRefs
+	alter.Direction = meta.Direction
+	alter.Meta = *meta
+	alter.ContentHash = computeContentHash(body)
+
+	return alter, nil
+}
+
+// buildLegacyEnvSpec translates the legacy requireEnv/skipEnv lists into
+// the structured per-environment model. It preserves the original
+// parser's whole-alter rule - "require-env" and "skip-env" cannot both be
+// non-empty on the same alter, regardless of which names they name - so
+// existing repos keep seeing the same parse error they always have; the
+// richer per-environment model only replaces that check for the new
+// TOML/structured header form.
+func buildLegacyEnvSpec(requireEnv, skipEnv []string, filePath string) (map[string]EnvSpec, *Error) {
+	if len(requireEnv) > 0 && len(skipEnv) > 0 {
+		return nil, &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf(
+				"Mutually exclusive fields 'require-env' and 'skip-env' cannot be used together in '%s'", filePath),
+		}
+	}
+
+	envs := make(map[string]EnvSpec, len(requireEnv)+len(skipEnv))
+	for _, name := range requireEnv {
+		envs[name] = EnvSpec{Require: true}
+	}
+	for _, name := range skipEnv {
+		envs[name] = EnvSpec{Skip: true}
+	}
+	return envs, nil
+}
+
+// metaEquivalent compares an up/down pair's structured Meta - ignoring
+// Direction, which is expected to differ - and returns a descriptive
+// Error on the first mismatch found.
+func metaEquivalent(up, down *Meta, upFile, downFile string) *Error {
+	if !stringSetEqual(up.BackRefs, down.BackRefs) {
+		return &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf("'backref' values for %s do not match (%v and %v)",
+				up.Ref, up.BackRefs, down.BackRefs),
+		}
+	}
+	if up.Transactional != down.Transactional {
+		return &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf("'transactional' differs between '%s' and '%s'", upFile, downFile),
+		}
+	}
+	if up.TimeoutSeconds != down.TimeoutSeconds {
+		return &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf("'timeout-seconds' differs between '%s' and '%s'", upFile, downFile),
+		}
+	}
+	if !stringSlicesEqual(up.Tags, down.Tags) {
+		return &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf("'tags' differ between '%s' and '%s'", upFile, downFile),
+		}
+	}
+	if len(up.Env) != len(down.Env) {
+		return &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf("environment configuration differs between '%s' and '%s'", upFile, downFile),
+		}
+	}
+	for name, spec := range up.Env {
+		otherSpec, ok := down.Env[name]
+		if !ok || otherSpec != spec {
+			return &Error{
+				ErrType: ErrInvalidMetaData,
+				Message: fmt.Sprintf(
+					"environment '%s' configuration differs between '%s' and '%s'", name, upFile, downFile),
+			}
+		}
+	}
+	return nil
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stringSetEqual compares a and b as sets (ignoring order and duplicate
+// counts of distinct values), used for back-refs, where a merge alter's
+// up and down declare the same parents but aren't required to list them
+// in the same order.
+func stringSetEqual(a, b []string) bool {
+	seenA := make(map[string]bool, len(a))
+	for _, s := range a {
+		seenA[s] = true
+	}
+	seenB := make(map[string]bool, len(b))
+	for _, s := range b {
+		if !seenA[s] {
+			return false
+		}
+		seenB[s] = true
+	}
+	return len(seenA) == len(seenB)
+}
+
+// envNamesWhere returns the sorted list of environment names in envs for
+// which predicate holds, used to populate AlterGroup's legacy
+// RequireEnv/SkipEnv fields from the structured Env map.
+func envNamesWhere(envs map[string]EnvSpec, predicate func(EnvSpec) bool) []string {
+	var names []string
+	for name, spec := range envs {
+		if predicate(spec) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
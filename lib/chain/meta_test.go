@@ -0,0 +1,111 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTOMLAlterBasic(t *testing.T) {
+	header := strings.Split(strings.TrimRight(`-- +++
+-- ref = "abc123"
+-- direction = "up"
+-- transactional = true
+-- timeout-seconds = 30
+-- tags = ["a", "b"]
+-- [env.production]
+-- require = true
+-- +++`, "\n"), "\n")
+
+	alter, cErr := parseTOMLAlter(header, "select 1;", "0001-abc-up.sql")
+	if cErr != nil {
+		t.Fatalf("parseTOMLAlter failed: %s", cErr.Message)
+	}
+	if alter.Ref() != "abc123" {
+		t.Fatalf("expected ref 'abc123', got %q", alter.Ref())
+	}
+	if alter.Direction != Up {
+		t.Fatalf("expected direction Up, got %v", alter.Direction)
+	}
+	if !alter.Meta.Transactional || alter.Meta.TimeoutSeconds != 30 {
+		t.Fatalf("unexpected meta: %+v", alter.Meta)
+	}
+	if spec, ok := alter.Meta.Env["production"]; !ok || !spec.Require {
+		t.Fatalf("expected 'production' to be required, got %+v", alter.Meta.Env)
+	}
+}
+
+func TestParseTOMLAlterRejectsSameEnvRequireAndSkip(t *testing.T) {
+	header := strings.Split(strings.TrimRight(`-- +++
+-- ref = "abc123"
+-- direction = "up"
+-- [env.production]
+-- require = true
+-- skip = true
+-- +++`, "\n"), "\n")
+
+	_, cErr := parseTOMLAlter(header, "select 1;", "0001-abc-up.sql")
+	if cErr == nil {
+		t.Fatal("expected an error for an environment that is both required and skipped")
+	}
+}
+
+func TestParseTOMLAlterUnterminatedFence(t *testing.T) {
+	header := []string{"-- +++", "-- ref = \"abc123\""}
+	_, cErr := parseTOMLAlter(header, "select 1;", "0001-abc-up.sql")
+	if cErr == nil {
+		t.Fatal("expected an error for an unterminated TOML fence")
+	}
+}
+
+func TestBuildLegacyEnvSpecMutualExclusion(t *testing.T) {
+	// A single alter declaring both require-env and skip-env is rejected
+	// outright, regardless of whether the env names overlap - this is the
+	// original parseMeta behavior and the legacy format must keep it.
+	_, cErr := buildLegacyEnvSpec([]string{"prod"}, []string{"staging"}, "0001-abc-up.sql")
+	if cErr == nil {
+		t.Fatal("expected require-env and skip-env on the same alter to be rejected")
+	}
+}
+
+func TestBuildLegacyEnvSpecAllowsDisjointSingleField(t *testing.T) {
+	envs, cErr := buildLegacyEnvSpec([]string{"prod", "staging"}, nil, "0001-abc-up.sql")
+	if cErr != nil {
+		t.Fatalf("unexpected error: %s", cErr.Message)
+	}
+	if !envs["prod"].Require || !envs["staging"].Require {
+		t.Fatalf("expected both envs to be required, got %+v", envs)
+	}
+}
+
+func TestMetaEquivalentDetectsMismatch(t *testing.T) {
+	up := &Meta{Ref: "abc", BackRefs: []string{"parent"}, Transactional: true}
+	down := &Meta{Ref: "abc", BackRefs: []string{"parent"}, Transactional: false}
+
+	if cErr := metaEquivalent(up, down, "up.sql", "down.sql"); cErr == nil {
+		t.Fatal("expected a mismatch error for differing Transactional values")
+	}
+}
+
+func TestMetaEquivalentIgnoresBackRefOrder(t *testing.T) {
+	up := &Meta{Ref: "abc", BackRefs: []string{"a", "b"}}
+	down := &Meta{Ref: "abc", BackRefs: []string{"b", "a"}}
+
+	if cErr := metaEquivalent(up, down, "up.sql", "down.sql"); cErr != nil {
+		t.Fatalf("expected back-refs in different order to be equivalent, got: %s", cErr.Message)
+	}
+}
@@ -0,0 +1,322 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// migrateIgnoreFile is the name of the gitignore-style file that excludes
+// paths from ScanTree on a per-directory basis.
+const migrateIgnoreFile = ".migrateignore"
+
+// ScanOptions configures ScanTree.
+type ScanOptions struct {
+	// Include is a list of doublestar glob patterns (matched against each
+	// file's path relative to the root it was found under) that a file
+	// must match to be considered an alter, e.g.
+	// "services/*/schema/**/*-{up,down}.sql". If empty, every file whose
+	// name matches the default alter filename convention is considered,
+	// same as ScanDirectory.
+	Include []string
+
+	// Exclude is a list of doublestar glob patterns; any file matching
+	// one is skipped even if it also matches Include.
+	Exclude []string
+
+	// FilePattern, if set, overrides the hardcoded alter filename regex
+	// used when Include is empty.
+	FilePattern string
+}
+
+// ScanTree walks each directory in roots recursively, returning a single
+// map of ref to AlterGroup spanning every root - so a monorepo with many
+// service-owned schema directories can be validated as one chain. Unlike
+// ScanDirectory, it honors ScanOptions.Include/Exclude glob patterns and
+// any ".migrateignore" files found along the way (gitignore-style,
+// evaluated hierarchically: a rule in a parent directory applies to all
+// of its descendants, and a more specific, deeper rule wins over one
+// inherited from a parent).
+func ScanTree(roots []string, opts ScanOptions) (map[string]*AlterGroup, *Error) {
+	matchesFileName, cErr := newAlterFileMatcher(opts.FilePattern)
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	alters := make(map[string]*AlterGroup)
+	ignoreCache := make(map[string][]*ignoreSet)
+
+	for _, root := range roots {
+		stat, err := os.Stat(root)
+		if err != nil || !stat.IsDir() {
+			return nil, &Error{
+				Underlying: err,
+				Message:    fmt.Sprintf("Path '%s' is not a directory", root),
+				ErrType:    ErrNonexistentDirectory,
+			}
+		}
+
+		if cErr := scanRoot(root, opts, matchesFileName, ignoreCache, alters); cErr != nil {
+			return nil, cErr
+		}
+	}
+
+	if len(alters) == 0 {
+		return nil, &Error{
+			ErrType: ErrEmptyDirectory,
+			Message: fmt.Sprintf("None of the given roots (%s) contain any alters", strings.Join(roots, ", ")),
+		}
+	}
+
+	return alters, nil
+}
+
+func scanRoot(
+	root string,
+	opts ScanOptions,
+	matchesFileName func(string) bool,
+	ignoreCache map[string][]*ignoreSet,
+	alters map[string]*AlterGroup,
+) *Error {
+	var walkErr *Error
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		sets, cErr := ignoreSetsFor(filepath.Dir(p), root, ignoreCache)
+		if cErr != nil {
+			walkErr = cErr
+			return cErr
+		}
+		if isIgnored(p, sets) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if len(opts.Include) > 0 {
+			if !matchesAny(opts.Include, rel) {
+				return nil
+			}
+		} else if !matchesFileName(info.Name()) {
+			return nil
+		}
+
+		if matchesAny(opts.Exclude, rel) {
+			return nil
+		}
+
+		header, body, cErr := readHeader(p)
+		if cErr != nil {
+			walkErr = cErr
+			return cErr
+		}
+		alter, cErr := parseMeta(header, body, p)
+		if cErr != nil {
+			walkErr = cErr
+			return cErr
+		}
+		alter.SourceRoot = root
+
+		group, ok := alters[alter.ref]
+		if !ok {
+			group = &AlterGroup{}
+		}
+		if alter.Direction == Up {
+			if group.Up != nil {
+				walkErr = &Error{
+					ErrType: ErrDuplicateRef,
+					Message: fmt.Sprintf("Duplicate 'up' alter for ref '%s'", alter.ref),
+				}
+				return walkErr
+			}
+			group.Up = alter
+		} else if alter.Direction == Down {
+			if group.Down != nil {
+				walkErr = &Error{
+					ErrType: ErrDuplicateRef,
+					Message: fmt.Sprintf("Duplicate 'down' alter for ref '%s'", alter.ref),
+				}
+				return walkErr
+			}
+			group.Down = alter
+		}
+		alters[alter.ref] = group
+
+		return nil
+	})
+
+	if walkErr != nil {
+		return walkErr
+	}
+	if err != nil {
+		return &Error{
+			ErrType:    ErrUnreadableAlter,
+			Message:    fmt.Sprintf("Unable to walk '%s': %s", root, err),
+			Underlying: err,
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newAlterFileMatcher returns a predicate over file names. An empty
+// pattern falls back to the default alter filename convention.
+func newAlterFileMatcher(pattern string) (func(string) bool, *Error) {
+	if pattern == "" {
+		return isAlterFile, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, &Error{
+			ErrType: ErrInvalidMetaData,
+			Message: fmt.Sprintf("Invalid alter file pattern '%s': %s", pattern, err),
+		}
+	}
+	return re.MatchString, nil
+}
+
+// ignoreRule is a single line from a ".migrateignore" file.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+}
+
+// ignoreSet is the set of rules contributed by one directory's
+// ".migrateignore" file.
+type ignoreSet struct {
+	dir   string
+	rules []ignoreRule
+}
+
+// loadMigrateIgnore reads and parses the ".migrateignore" file in dir, if
+// one exists. A missing file is not an error.
+func loadMigrateIgnore(dir string) (*ignoreSet, *Error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, migrateIgnoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, &Error{
+			ErrType:    ErrUnreadableAlter,
+			Message:    fmt.Sprintf("Unable to read '%s'", filepath.Join(dir, migrateIgnoreFile)),
+			Underlying: err,
+		}
+	}
+
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negate := strings.HasPrefix(line, "!")
+		if negate {
+			line = line[1:]
+		}
+		rules = append(rules, ignoreRule{pattern: line, negate: negate})
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return &ignoreSet{dir: dir, rules: rules}, nil
+}
+
+// ignoreSetsFor returns the chain of ignoreSets that apply to dir, in
+// order from root down to dir, loading and caching each directory's
+// ".migrateignore" as it's first encountered.
+func ignoreSetsFor(dir, root string, cache map[string][]*ignoreSet) ([]*ignoreSet, *Error) {
+	if cached, ok := cache[dir]; ok {
+		return cached, nil
+	}
+
+	var chain []*ignoreSet
+	if dir != root {
+		parentChain, cErr := ignoreSetsFor(filepath.Dir(dir), root, cache)
+		if cErr != nil {
+			return nil, cErr
+		}
+		chain = append(chain, parentChain...)
+	}
+
+	set, cErr := loadMigrateIgnore(dir)
+	if cErr != nil {
+		return nil, cErr
+	}
+	if set != nil {
+		chain = append(chain, set)
+	}
+
+	cache[dir] = chain
+	return chain, nil
+}
+
+// isIgnored reports whether path is excluded by any rule in sets. Sets
+// must be ordered root-to-leaf; within that order the last matching rule
+// wins, so a deeper, more specific ".migrateignore" can re-include a path
+// an ancestor excluded (or vice versa).
+func isIgnored(path string, sets []*ignoreSet) bool {
+	ignored := false
+	for _, set := range sets {
+		rel, err := filepath.Rel(set.dir, path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+
+		for _, rule := range set.rules {
+			matched, _ := doublestar.Match(rule.pattern, rel)
+			if !matched {
+				// gitignore treats "foo" as matching the directory "foo"
+				// and everything beneath it, not just a file named "foo"
+				matched, _ = doublestar.Match(rule.pattern+"/**", rel)
+			}
+			if !matched && !strings.Contains(rule.pattern, "/") {
+				// A slash-less pattern (e.g. "*.bak" or an exact filename)
+				// matches at any depth under dir, not just directly inside it.
+				matched, _ = doublestar.Match("**/"+rule.pattern, rel)
+			}
+			if matched {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
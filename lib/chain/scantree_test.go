@@ -0,0 +1,124 @@
+// <--
+// Copyright © 2017 AppNexus Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// -->
+
+package chain
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestScanTreeHonorsInclude(t *testing.T) {
+	root, err := ioutil.TempDir("", "schema-tool-scantree")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	svcDir := path.Join(root, "services", "foo", "schema")
+	if err := os.MkdirAll(svcDir, 0755); err != nil {
+		t.Fatalf("unable to create service dir: %s", err)
+	}
+	writeAlterFile(t, svcDir, 0, "up")
+	writeAlterFile(t, svcDir, 0, "down")
+
+	otherDir := path.Join(root, "not-schema")
+	if err := os.MkdirAll(otherDir, 0755); err != nil {
+		t.Fatalf("unable to create other dir: %s", err)
+	}
+	writeAlterFile(t, otherDir, 1, "up")
+	writeAlterFile(t, otherDir, 1, "down")
+
+	alters, cErr := ScanTree([]string{root}, ScanOptions{
+		Include: []string{"services/*/schema/*-{up,down}.sql"},
+	})
+	if cErr != nil {
+		t.Fatalf("ScanTree failed: %s", cErr.Message)
+	}
+	if _, ok := alters["ref0000"]; !ok {
+		t.Fatal("expected ref0000 to be scanned")
+	}
+	if _, ok := alters["ref0001"]; ok {
+		t.Fatal("expected ref0001 to be excluded by Include")
+	}
+}
+
+func TestScanTreeMigrateIgnoreMatchesNestedDepth(t *testing.T) {
+	root, err := ioutil.TempDir("", "schema-tool-scantree-ignore")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// A bare filename in a parent ".migrateignore" (no "/" in the
+	// pattern) must ignore a file with that name at any depth below it,
+	// not just directly inside the directory holding the rule.
+	ignoreFile := "0000-case-up.sql\n0000-case-down.sql\n"
+	if err := ioutil.WriteFile(path.Join(root, migrateIgnoreFile), []byte(ignoreFile), 0644); err != nil {
+		t.Fatalf("unable to write .migrateignore: %s", err)
+	}
+
+	subDir := path.Join(root, "sub")
+	if err := os.MkdirAll(subDir, 0755); err != nil {
+		t.Fatalf("unable to create sub dir: %s", err)
+	}
+	writeAlterFile(t, subDir, 0, "up")
+	writeAlterFile(t, subDir, 0, "down")
+	writeAlterFile(t, root, 1, "up")
+	writeAlterFile(t, root, 1, "down")
+
+	alters, cErr := ScanTree([]string{root}, ScanOptions{})
+	if cErr != nil {
+		t.Fatalf("ScanTree failed: %s", cErr.Message)
+	}
+	if _, ok := alters["ref0000"]; ok {
+		t.Fatal("expected ref0000 (nested under sub/) to be ignored by the bare filename rule")
+	}
+	if _, ok := alters["ref0001"]; !ok {
+		t.Fatal("expected ref0001 to still be scanned")
+	}
+}
+
+func TestScanTreeMigrateIgnoreDeeperRuleCanReinclude(t *testing.T) {
+	root, err := ioutil.TempDir("", "schema-tool-scantree-reinclude")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := ioutil.WriteFile(path.Join(root, migrateIgnoreFile), []byte("*.sql\n"), 0644); err != nil {
+		t.Fatalf("unable to write root .migrateignore: %s", err)
+	}
+
+	subDir := path.Join(root, "sub")
+	if err := os.MkdirAll(subDir, 0755); err != nil {
+		t.Fatalf("unable to create sub dir: %s", err)
+	}
+	if err := ioutil.WriteFile(path.Join(subDir, migrateIgnoreFile), []byte("!*.sql\n"), 0644); err != nil {
+		t.Fatalf("unable to write nested .migrateignore: %s", err)
+	}
+	writeAlterFile(t, subDir, 0, "up")
+	writeAlterFile(t, subDir, 0, "down")
+
+	alters, cErr := ScanTree([]string{root}, ScanOptions{})
+	if cErr != nil {
+		t.Fatalf("ScanTree failed: %s", cErr.Message)
+	}
+	if _, ok := alters["ref0000"]; !ok {
+		t.Fatal("expected the deeper negated rule to re-include ref0000")
+	}
+}